@@ -0,0 +1,389 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogConfig configures the access log subsystem: where entries
+// are written, in what format, and whether they're also forwarded to
+// syslog. It is used both for the top-level, server-wide log (set via
+// flags) and, per Rule, to override or disable it.
+type AccessLogConfig struct {
+	Format string // "common", "combined" or "json"; defaults to "combined"
+
+	File       string // destination file path; "" means stdout
+	MaxSizeMB  int    // rotate File once it exceeds this size; 0 disables rotation
+	MaxBackups int    // number of rotated files to keep; defaults to 5 if MaxSizeMB > 0
+
+	Syslog string // "local" or "network:address" (e.g. "udp:localhost:514") to additionally forward entries; "" disables
+
+	Disabled bool // if true, a per-Rule config suppresses access logging entirely
+
+	logger *accessLogger
+}
+
+// compile builds the accessLogger described by c, unless c disables
+// logging outright.
+func (c *AccessLogConfig) compile() error {
+	if c.Disabled {
+		return nil
+	}
+	al, err := newAccessLogger(*c)
+	if err != nil {
+		return fmt.Errorf("access log: %v", err)
+	}
+	c.logger = al
+	return nil
+}
+
+// defaultAccessLogger is the server-wide access logger, installed by
+// main from flags. It defaults to Combined Log Format on stdout so
+// that webfront logs access by default, in the style of most reverse
+// proxies.
+var defaultAccessLogger = mustNewAccessLogger(AccessLogConfig{Format: "combined"})
+
+func mustNewAccessLogger(cfg AccessLogConfig) *accessLogger {
+	al, err := newAccessLogger(cfg)
+	if err != nil {
+		panic(err) // cfg is a constant, known-good config
+	}
+	return al
+}
+
+// accessLogger formats and writes access log entries to an output
+// stream and, optionally, to syslog.
+type accessLogger struct {
+	format string
+
+	mu  sync.Mutex
+	out io.Writer
+
+	sl *syslog.Writer
+}
+
+// newAccessLogger constructs an accessLogger from cfg, opening cfg.File
+// (with rotation, if configured) and dialing cfg.Syslog, if set.
+func newAccessLogger(cfg AccessLogConfig) (*accessLogger, error) {
+	format := cfg.Format
+	if format == "" {
+		format = "combined"
+	}
+	switch format {
+	case "common", "combined", "json":
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+
+	var out io.Writer = os.Stdout
+	if cfg.File != "" {
+		if cfg.MaxSizeMB > 0 {
+			rf, err := newRotatingFile(cfg.File, cfg.MaxSizeMB, cfg.MaxBackups)
+			if err != nil {
+				return nil, err
+			}
+			out = rf
+		} else {
+			f, err := os.OpenFile(cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return nil, err
+			}
+			out = f
+		}
+	}
+
+	al := &accessLogger{format: format, out: out}
+	if cfg.Syslog != "" {
+		sl, err := dialSyslog(cfg.Syslog)
+		if err != nil {
+			return nil, fmt.Errorf("syslog: %v", err)
+		}
+		al.sl = sl
+	}
+	return al, nil
+}
+
+// dialSyslog connects to a syslog daemon as described by addr: "local"
+// for the host's local syslog socket, or "network:address" (e.g.
+// "udp:localhost:514") for a remote one.
+func dialSyslog(addr string) (*syslog.Writer, error) {
+	const (
+		tag      = "webfront"
+		priority = syslog.LOG_INFO | syslog.LOG_LOCAL0
+	)
+	if addr == "local" {
+		return syslog.New(priority, tag)
+	}
+	network, raddr, ok := strings.Cut(addr, ":")
+	if !ok {
+		return nil, fmt.Errorf("bad syslog address %q, want \"local\" or \"network:address\"", addr)
+	}
+	return syslog.Dial(network, raddr, priority, tag)
+}
+
+// log formats e according to al.format and writes it to al's output and,
+// if configured, to syslog.
+func (al *accessLogger) log(e accessEntry) {
+	var line string
+	switch al.format {
+	case "common":
+		line = e.commonFormat()
+	case "json":
+		line = e.jsonFormat()
+	default: // "combined"
+		line = e.combinedFormat()
+	}
+
+	al.mu.Lock()
+	io.WriteString(al.out, line+"\n")
+	al.mu.Unlock()
+
+	if al.sl != nil {
+		al.sl.Info(line)
+	}
+}
+
+// accessEntry holds the fields recorded for a single request.
+type accessEntry struct {
+	Time       time.Time
+	Method     string
+	Host       string
+	Path       string
+	Proto      string
+	Status     int
+	Bytes      int64
+	Upstream   string
+	Latency    time.Duration
+	RemoteAddr string
+	Referer    string
+	UserAgent  string
+}
+
+// clfPrefix renders the fields common to the Common and Combined Log
+// Formats.
+func (e accessEntry) clfPrefix() string {
+	return fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %d`,
+		dashIfEmpty(e.RemoteAddr), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.Path, e.Proto, e.Status, e.Bytes)
+}
+
+// extras appends the upstream address and latency that CLF has no room
+// for, in the style of an extended/custom log format.
+func (e accessEntry) extras() string {
+	return fmt.Sprintf("upstream=%s latency=%s", dashIfEmpty(e.Upstream), e.Latency)
+}
+
+func (e accessEntry) commonFormat() string {
+	return e.clfPrefix() + " " + e.extras()
+}
+
+func (e accessEntry) combinedFormat() string {
+	return fmt.Sprintf(`%s "%s" "%s" %s`, e.clfPrefix(), e.Referer, e.UserAgent, e.extras())
+}
+
+func (e accessEntry) jsonFormat() string {
+	b, err := json.Marshal(struct {
+		Time       string  `json:"time"`
+		Method     string  `json:"method"`
+		Host       string  `json:"host"`
+		Path       string  `json:"path"`
+		Status     int     `json:"status"`
+		Bytes      int64   `json:"bytes"`
+		Upstream   string  `json:"upstream,omitempty"`
+		LatencyMS  float64 `json:"latency_ms"`
+		RemoteAddr string  `json:"remote_addr,omitempty"`
+		Referer    string  `json:"referer,omitempty"`
+		UserAgent  string  `json:"user_agent,omitempty"`
+	}{
+		Time:       e.Time.Format(time.RFC3339),
+		Method:     e.Method,
+		Host:       e.Host,
+		Path:       e.Path,
+		Status:     e.Status,
+		Bytes:      e.Bytes,
+		Upstream:   e.Upstream,
+		LatencyMS:  float64(e.Latency) / float64(time.Millisecond),
+		RemoteAddr: e.RemoteAddr,
+		Referer:    e.Referer,
+		UserAgent:  e.UserAgent,
+	})
+	if err != nil {
+		log.Printf("access log: marshal entry: %v", err)
+		return "{}"
+	}
+	return string(b)
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// logAccess records a single request in the access log, honoring a
+// per-Rule override or opt-out (rule may be nil, for unmatched
+// requests).
+func logAccess(rule *Rule, r *http.Request, w *loggingResponseWriter, upstream string, dur time.Duration) {
+	logger := defaultAccessLogger
+	if rule != nil && rule.AccessLog != nil {
+		if rule.AccessLog.Disabled {
+			return
+		}
+		if rule.AccessLog.logger != nil {
+			logger = rule.AccessLog.logger
+		}
+	}
+	if logger == nil {
+		return
+	}
+	logger.log(accessEntry{
+		Time:       time.Now(),
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		Proto:      r.Proto,
+		Status:     w.status,
+		Bytes:      w.bytes,
+		Upstream:   upstream,
+		Latency:    dur,
+		RemoteAddr: clientIP(r),
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+	})
+}
+
+// loggingResponseWriter wraps an http.ResponseWriter to capture the
+// status code and byte count of the response, for the access log.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *loggingResponseWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher, if the wrapped ResponseWriter does, so
+// that streamed proxy responses still flush incrementally.
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, if the wrapped ResponseWriter does,
+// so that WebSocket upgrades still work through the access log wrapper.
+func (w *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// rotatingFile is an io.Writer over a file that rotates itself once it
+// exceeds maxSize bytes, keeping up to maxBackups old copies named
+// path.1 (newest) through path.N (oldest).
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// newRotatingFile opens (or creates) path for appending, rotating it
+// once it grows past maxSizeMB megabytes. maxBackups defaults to 5.
+func newRotatingFile(path string, maxSizeMB, maxBackups int) (*rotatingFile, error) {
+	if maxBackups <= 0 {
+		maxBackups = 5
+	}
+	rf := &rotatingFile{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1 << 20,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.size+int64(len(b)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			log.Printf("access log: rotate %s: %v", rf.path, err)
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate closes the current file, shifts path.1..path.N-1 up by one
+// (discarding path.N), renames path to path.1, and reopens path fresh.
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	rf.size = 0
+	return rf.open()
+}
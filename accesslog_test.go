@@ -0,0 +1,145 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessEntryFormats(t *testing.T) {
+	e := accessEntry{
+		Time:       time.Date(2026, time.July, 29, 12, 0, 0, 0, time.UTC),
+		Method:     "GET",
+		Host:       "example.com",
+		Path:       "/foo",
+		Proto:      "HTTP/1.1",
+		Status:     200,
+		Bytes:      42,
+		Upstream:   "10.0.0.1:8080",
+		Latency:    150 * time.Millisecond,
+		RemoteAddr: "1.2.3.4",
+		Referer:    "http://ref.example/",
+		UserAgent:  "test-agent",
+	}
+
+	common := e.commonFormat()
+	for _, want := range []string{`"GET /foo HTTP/1.1" 200 42`, "upstream=10.0.0.1:8080", "latency=150ms"} {
+		if !strings.Contains(common, want) {
+			t.Errorf("commonFormat() = %q, want substring %q", common, want)
+		}
+	}
+
+	combined := e.combinedFormat()
+	for _, want := range []string{common[:len(common)-len(e.extras())-1], `"http://ref.example/"`, `"test-agent"`} {
+		if !strings.Contains(combined, want) {
+			t.Errorf("combinedFormat() = %q, want substring %q", combined, want)
+		}
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(e.jsonFormat()), &parsed); err != nil {
+		t.Fatalf("jsonFormat() produced invalid JSON: %v", err)
+	}
+	if got, want := parsed["upstream"], "10.0.0.1:8080"; got != want {
+		t.Errorf("jsonFormat() upstream = %v, want %v", got, want)
+	}
+	if got, want := parsed["latency_ms"], 150.0; got != want {
+		t.Errorf("jsonFormat() latency_ms = %v, want %v", got, want)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webfront-accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/access.log"
+
+	rf, err := newRotatingFile(path, 0, 2) // maxSizeMB*1<<20 rounds to 0, so force a tiny size below
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf.maxSize = 10 // rotate after 10 bytes, for the test
+
+	for i := 0; i < 3; i++ {
+		if _, err := rf.Write([]byte("0123456789\n")); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	for _, suffix := range []string{"", ".1", ".2"} {
+		if _, err := os.Stat(path + suffix); err != nil {
+			t.Errorf("expected %s%s to exist: %v", path, suffix, err)
+		}
+	}
+}
+
+func TestAccessLogPerRuleOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webfront-accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := dir + "/rule.log"
+
+	target := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer target.Close()
+
+	ruleFile := writeRules([]*Rule{
+		{
+			Host:      "logged.example.com",
+			Forward:   target.Listener.Addr().String(),
+			AccessLog: &AccessLogConfig{Format: "json", File: logPath},
+		},
+		{
+			Host:      "quiet.example.com",
+			Forward:   target.Listener.Addr().String(),
+			AccessLog: &AccessLogConfig{Disabled: true},
+		},
+	})
+	defer os.Remove(ruleFile)
+
+	s, err := NewServer(ruleFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"logged.example.com", "quiet.example.com"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://"+host+"/", nil)
+		s.ServeHTTP(rw, req)
+	}
+
+	data, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("reading log file: %v", err)
+	}
+	if !strings.Contains(string(data), `"host":"logged.example.com"`) {
+		t.Errorf("log file = %q, want an entry for logged.example.com", data)
+	}
+	if strings.Contains(string(data), "quiet.example.com") {
+		t.Errorf("log file = %q, want no entry for quiet.example.com", data)
+	}
+}
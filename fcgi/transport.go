@@ -0,0 +1,435 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fcgi implements the client side of the FastCGI protocol, so
+// that an HTTP request can be proxied straight to a FastCGI responder
+// such as php-fpm. The standard library's net/http/fcgi only
+// implements the server side (for writing a FastCGI responder in Go),
+// so it has no client this package can reuse.
+package fcgi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Record types, as defined by the FastCGI specification.
+const (
+	typeBeginRequest = 1
+	typeEndRequest   = 3
+	typeParams       = 4
+	typeStdin        = 5
+	typeStdout       = 6
+	typeStderr       = 7
+)
+
+const (
+	roleResponder = 1
+
+	fcgiVersion1 = 1
+
+	maxRecordContent = 65535 // a record's content length is a uint16
+)
+
+// header is a FastCGI record header, sent on the wire in network byte
+// order.
+type header struct {
+	Version       uint8
+	Type          uint8
+	RequestID     uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// beginRequestBody is the content of a FCGI_BEGIN_REQUEST record.
+type beginRequestBody struct {
+	Role     uint16
+	Flags    uint8
+	Reserved [5]uint8
+}
+
+// endRequestBody is the content of a FCGI_END_REQUEST record.
+type endRequestBody struct {
+	AppStatus      uint32
+	ProtocolStatus uint8
+	Reserved       [3]uint8
+}
+
+// requestID is fixed: Transport never multiplexes several requests
+// over one connection.
+const requestID = 1
+
+// Transport is an http.Handler that proxies each request to a
+// FastCGI responder, translating it into FCGI_BEGIN_REQUEST,
+// FCGI_PARAMS and FCGI_STDIN records and translating the responder's
+// FCGI_STDOUT back into an HTTP response. FCGI_STDERR is not logged; it
+// only turns the response into a 502 when no response headers were
+// written.
+type Transport struct {
+	Network string // "tcp" (default) or "unix"
+	Addr    string // responder address
+
+	Root  string // document root, used to build SCRIPT_FILENAME
+	Index string // file served for a request mapping to a directory; defaults to "index.php"
+}
+
+func (t *Transport) network() string {
+	if t.Network == "" {
+		return "tcp"
+	}
+	return t.Network
+}
+
+func (t *Transport) index() string {
+	if t.Index == "" {
+		return "index.php"
+	}
+	return t.Index
+}
+
+// ServeHTTP dials the responder, runs one FastCGI request, and copies
+// its response back to w. The connection is closed, aborting the
+// request, if r's context is done before the responder finishes.
+func (t *Transport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := net.Dial(t.network(), t.Addr)
+	if err != nil {
+		http.Error(w, "Bad gateway.", http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := writeBeginRequest(conn); err != nil {
+		http.Error(w, "Bad gateway.", http.StatusBadGateway)
+		return
+	}
+	if err := writeParams(conn, t.params(r)); err != nil {
+		http.Error(w, "Bad gateway.", http.StatusBadGateway)
+		return
+	}
+	if err := writeStdin(conn, r.Body); err != nil {
+		http.Error(w, "Bad gateway.", http.StatusBadGateway)
+		return
+	}
+
+	cw := &cgiResponseWriter{w: w}
+	if err := readResponse(cw, conn); err != nil {
+		if !cw.headersSent {
+			http.Error(w, "Bad gateway.", http.StatusBadGateway)
+		}
+		return
+	}
+}
+
+// params builds the CGI parameters describing r, as a FastCGI
+// responder expects them.
+func (t *Transport) params(r *http.Request) map[string]string {
+	// path.Clean collapses any ".." segments in a rooted path, so the
+	// result can never climb above docRoot.
+	scriptName := path.Clean("/" + r.URL.Path)
+	docRoot := strings.TrimSuffix(t.Root, "/")
+	scriptFilename := docRoot + scriptName
+	if scriptName == "/" || strings.HasSuffix(r.URL.Path, "/") {
+		scriptFilename = path.Join(docRoot, scriptName, t.index())
+	}
+
+	remoteAddr, remotePort := splitHostPort(r.RemoteAddr)
+	serverName, serverPort := splitHostPort(r.Host)
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_SOFTWARE":   "webfront",
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   scriptFilename,
+		"DOCUMENT_ROOT":     docRoot,
+		"QUERY_STRING":      r.URL.RawQuery,
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+		"REMOTE_ADDR":       remoteAddr,
+		"REMOTE_PORT":       remotePort,
+		"SERVER_NAME":       serverName,
+		"SERVER_PORT":       serverPort,
+	}
+	if r.ContentLength > 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	for k, vs := range r.Header {
+		key := "HTTP_" + strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		params[key] = strings.Join(vs, ", ")
+	}
+	return params
+}
+
+func splitHostPort(hostport string) (host, port string) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport, ""
+	}
+	return host, port
+}
+
+// writeRecord writes content as one or more FastCGI records of typ,
+// splitting it into at most maxRecordContent-byte chunks (a
+// single call with len(content) == 0 writes the terminating empty
+// record a FastCGI stream ends with).
+func writeRecord(w io.Writer, typ uint8, content []byte) error {
+	for {
+		chunk := content
+		if len(chunk) > maxRecordContent {
+			chunk = chunk[:maxRecordContent]
+		}
+		pad := -len(chunk) & 7 // pad to a multiple of 8 bytes
+		h := header{
+			Version:       fcgiVersion1,
+			Type:          typ,
+			RequestID:     requestID,
+			ContentLength: uint16(len(chunk)),
+			PaddingLength: uint8(pad),
+		}
+		if err := binary.Write(w, binary.BigEndian, h); err != nil {
+			return err
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		if _, err := w.Write(make([]byte, pad)); err != nil {
+			return err
+		}
+		content = content[len(chunk):]
+		if len(content) == 0 {
+			return nil
+		}
+	}
+}
+
+func writeBeginRequest(w io.Writer) error {
+	body := beginRequestBody{Role: roleResponder}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, body)
+	return writeRecord(w, typeBeginRequest, buf.Bytes())
+}
+
+// writeParams encodes params as FastCGI name-value pairs and writes
+// them as one or more FCGI_PARAMS records, followed by the empty
+// record that terminates the stream.
+func writeParams(w io.Writer, params map[string]string) error {
+	var buf []byte
+	for k, v := range params {
+		buf = appendNameValue(buf, k, v)
+	}
+	if err := writeRecord(w, typeParams, buf); err != nil {
+		return err
+	}
+	return writeRecord(w, typeParams, nil)
+}
+
+func appendNameValue(buf []byte, name, value string) []byte {
+	buf = appendLength(buf, len(name))
+	buf = appendLength(buf, len(value))
+	buf = append(buf, name...)
+	buf = append(buf, value...)
+	return buf
+}
+
+func appendLength(buf []byte, n int) []byte {
+	if n < 128 {
+		return append(buf, byte(n))
+	}
+	return append(buf, byte(n>>24)|0x80, byte(n>>16), byte(n>>8), byte(n))
+}
+
+// writeStdin streams body to the responder as FCGI_STDIN records,
+// followed by the empty record that terminates the stream.
+func writeStdin(w io.Writer, body io.Reader) error {
+	if body != nil {
+		buf := make([]byte, maxRecordContent)
+		for {
+			n, err := body.Read(buf)
+			if n > 0 {
+				if werr := writeRecord(w, typeStdin, buf[:n]); werr != nil {
+					return werr
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return writeRecord(w, typeStdin, nil)
+}
+
+// readResponse reads FCGI_STDOUT/FCGI_STDERR/FCGI_END_REQUEST records
+// from r until the request completes, streaming FCGI_STDOUT to cw as
+// it arrives (after parsing off the CGI header block it begins with).
+// FCGI_STDERR is accumulated and, if stdout never completed its CGI
+// header block (so no headers have been written to cw), surfaced as the
+// returned error; otherwise it is discarded.
+func readResponse(cw *cgiResponseWriter, r io.Reader) error {
+	br := bufio.NewReader(r)
+	var stderr []byte
+	for {
+		var h header
+		if err := binary.Read(br, binary.BigEndian, &h); err != nil {
+			return fmt.Errorf("reading record header: %v", err)
+		}
+		content := make([]byte, h.ContentLength)
+		if _, err := io.ReadFull(br, content); err != nil {
+			return fmt.Errorf("reading record content: %v", err)
+		}
+		if _, err := io.CopyN(io.Discard, br, int64(h.PaddingLength)); err != nil {
+			return err
+		}
+		switch h.Type {
+		case typeStdout:
+			if len(content) == 0 {
+				continue
+			}
+			if err := cw.write(content); err != nil {
+				return err
+			}
+		case typeStderr:
+			stderr = append(stderr, content...)
+		case typeEndRequest:
+			if !cw.headersSent && len(stderr) > 0 {
+				return fmt.Errorf("fastcgi responder error: %s", stderr)
+			}
+			return cw.flushHeaders()
+		default:
+			return fmt.Errorf("unexpected record type %d", h.Type)
+		}
+	}
+}
+
+// maxHeaderBlock bounds how much of a responder's stdout
+// cgiResponseWriter will buffer while looking for the blank line ending
+// the CGI header block, so a responder that never sends one can't
+// exhaust memory.
+const maxHeaderBlock = 1 << 20 // 1MB, matching net/http.DefaultMaxHeaderBytes
+
+// cgiResponseWriter buffers FCGI_STDOUT content only until it has seen
+// the CGI header block (a "Status:" line and/or ordinary headers
+// followed by a blank line) stdout begins with; once the headers are
+// parsed and written to w, further content is written straight
+// through.
+type cgiResponseWriter struct {
+	w           http.ResponseWriter
+	buf         bytes.Buffer
+	headersSent bool
+}
+
+func (cw *cgiResponseWriter) write(p []byte) error {
+	if cw.headersSent {
+		_, err := cw.w.Write(p)
+		return err
+	}
+	cw.buf.Write(p)
+	if cw.buf.Len() > maxHeaderBlock {
+		return fmt.Errorf("fastcgi response exceeded %d bytes without ending its CGI header block", maxHeaderBlock)
+	}
+	idx := headerBlockEnd(cw.buf.Bytes())
+	if idx < 0 {
+		return nil // still accumulating the header block
+	}
+	body := append([]byte(nil), cw.buf.Bytes()[idx:]...)
+	if err := cw.writeHeaders(cw.buf.Bytes()[:idx]); err != nil {
+		return err
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	_, err := cw.w.Write(body)
+	return err
+}
+
+// flushHeaders writes out the CGI header block if the responder's
+// entire stdout turned out to be smaller than it (e.g. a response with
+// headers but no body); it's a no-op once writeHeaders has already run.
+func (cw *cgiResponseWriter) flushHeaders() error {
+	if cw.headersSent {
+		return nil
+	}
+	return cw.writeHeaders(cw.buf.Bytes())
+}
+
+// headerBlockEnd returns the index just past the blank line ending
+// the CGI header block in b, or -1 if it hasn't been seen yet. A
+// response with no headers at all starts with the blank line itself.
+func headerBlockEnd(b []byte) int {
+	if bytes.HasPrefix(b, []byte("\r\n")) {
+		return 2
+	}
+	if bytes.HasPrefix(b, []byte("\n")) {
+		return 1
+	}
+	if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+		return i + 4
+	}
+	if i := bytes.Index(b, []byte("\n\n")); i >= 0 {
+		return i + 2
+	}
+	return -1
+}
+
+// writeHeaders parses the CGI header block and writes the resulting
+// status and headers to cw.w.
+func (cw *cgiResponseWriter) writeHeaders(block []byte) error {
+	cw.headersSent = true
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(block)))
+	mimeHeader, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("parsing CGI headers: %v", err)
+	}
+
+	status := http.StatusOK
+	if s := mimeHeader.Get("Status"); s != "" {
+		mimeHeader.Del("Status")
+		code, _, _ := strings.Cut(s, " ")
+		if n, err := strconv.Atoi(code); err == nil {
+			status = n
+		}
+	}
+	for k, vs := range mimeHeader {
+		for _, v := range vs {
+			cw.w.Header().Add(k, v)
+		}
+	}
+	cw.w.WriteHeader(status)
+	return nil
+}
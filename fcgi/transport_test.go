@@ -0,0 +1,173 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fcgi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stubResponder is a minimal FastCGI server, enough to drive Transport
+// through one request and assert what it sent.
+type stubResponder struct {
+	ln net.Listener
+
+	gotParams map[string]string
+	gotStdin  []byte
+
+	response string // raw CGI-style response (headers + blank line + body) to send back
+}
+
+func newStubResponder(t *testing.T, response string) *stubResponder {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stubResponder{ln: ln, response: response}
+	go s.serveOne(t)
+	return s
+}
+
+func (s *stubResponder) addr() string { return s.ln.Addr().String() }
+
+func (s *stubResponder) serveOne(t *testing.T) {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	s.gotParams = make(map[string]string)
+	var paramBuf []byte
+loop:
+	for {
+		h, content := readRecord(t, br)
+		switch h.Type {
+		case typeParams:
+			if len(content) == 0 {
+				decodeParams(paramBuf, s.gotParams)
+				continue
+			}
+			paramBuf = append(paramBuf, content...)
+		case typeStdin:
+			if len(content) == 0 {
+				break loop
+			}
+			s.gotStdin = append(s.gotStdin, content...)
+		}
+	}
+
+	writeRecord(conn, typeStdout, []byte(s.response))
+	writeRecord(conn, typeStdout, nil)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, endRequestBody{})
+	writeRecord(conn, typeEndRequest, buf.Bytes())
+}
+
+func readRecord(t *testing.T, br *bufio.Reader) (header, []byte) {
+	var h header
+	if err := binary.Read(br, binary.BigEndian, &h); err != nil {
+		t.Fatalf("reading record header: %v", err)
+	}
+	content := make([]byte, h.ContentLength)
+	if _, err := io.ReadFull(br, content); err != nil {
+		t.Fatalf("reading record content: %v", err)
+	}
+	if _, err := io.CopyN(io.Discard, br, int64(h.PaddingLength)); err != nil {
+		t.Fatalf("reading record padding: %v", err)
+	}
+	return h, content
+}
+
+// decodeParams decodes b, the concatenated content of one request's
+// FCGI_PARAMS records, as FastCGI name-value pairs into out.
+func decodeParams(b []byte, out map[string]string) {
+	for len(b) > 0 {
+		nameLen, n := readLength(b)
+		b = b[n:]
+		valueLen, n := readLength(b)
+		b = b[n:]
+		name := string(b[:nameLen])
+		b = b[nameLen:]
+		value := string(b[:valueLen])
+		b = b[valueLen:]
+		out[name] = value
+	}
+}
+
+func readLength(b []byte) (int, int) {
+	if b[0]&0x80 == 0 {
+		return int(b[0]), 1
+	}
+	n := int(b[0]&0x7f)<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	return n, 4
+}
+
+func TestTransportServeHTTP(t *testing.T) {
+	stub := newStubResponder(t, "Status: 201 Created\r\nX-From: stub\r\n\r\nhello from fastcgi")
+
+	tr := &Transport{Addr: stub.addr(), Root: "/var/www"}
+	req := httptest.NewRequest("POST", "http://example.com/app.php?a=1", nil)
+	req.Header.Set("User-Agent", "test")
+	rw := httptest.NewRecorder()
+
+	tr.ServeHTTP(rw, req)
+
+	if got, want := rw.Code, http.StatusCreated; got != want {
+		t.Errorf("status = %d, want %d", got, want)
+	}
+	if got, want := rw.Body.String(), "hello from fastcgi"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+	if got, want := rw.Header().Get("X-From"), "stub"; got != want {
+		t.Errorf("X-From header = %q, want %q", got, want)
+	}
+
+	if got, want := stub.gotParams["SCRIPT_FILENAME"], "/var/www/app.php"; got != want {
+		t.Errorf("SCRIPT_FILENAME = %q, want %q", got, want)
+	}
+	if got, want := stub.gotParams["REQUEST_METHOD"], "POST"; got != want {
+		t.Errorf("REQUEST_METHOD = %q, want %q", got, want)
+	}
+	if got, want := stub.gotParams["QUERY_STRING"], "a=1"; got != want {
+		t.Errorf("QUERY_STRING = %q, want %q", got, want)
+	}
+	if got, want := stub.gotParams["HTTP_USER_AGENT"], "test"; got != want {
+		t.Errorf("HTTP_USER_AGENT = %q, want %q", got, want)
+	}
+}
+
+func TestTransportIndexFile(t *testing.T) {
+	stub := newStubResponder(t, "\r\nok")
+
+	tr := &Transport{Addr: stub.addr(), Root: "/var/www", Index: "index.php"}
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	rw := httptest.NewRecorder()
+
+	tr.ServeHTTP(rw, req)
+
+	if got, want := stub.gotParams["SCRIPT_FILENAME"], "/var/www/index.php"; got != want {
+		t.Errorf("SCRIPT_FILENAME = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseHtpasswd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	contents := "alice:hunter2\n# a comment\n\nbob:{SHA}87u9ZqY9S/F0eUBXjsPQEDUw4h0=\n"
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := parseHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"alice": "hunter2",
+		"bob":   "{SHA}87u9ZqY9S/F0eUBXjsPQEDUw4h0=",
+	}
+	if len(users) != len(want) {
+		t.Fatalf("parseHtpasswd() = %v, want %v", users, want)
+	}
+	for u, hash := range want {
+		if users[u] != hash {
+			t.Errorf("users[%q] = %q, want %q", u, users[u], hash)
+		}
+	}
+
+	if _, err := parseHtpasswd(path + "-missing"); err == nil {
+		t.Error("parseHtpasswd of a missing file returned nil error, want one")
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		hash, password string
+		want           bool
+	}{
+		{"hunter2", "hunter2", true},
+		{"hunter2", "wrong", false},
+		{"{SHA}87u9ZqY9S/F0eUBXjsPQEDUw4h0=", "hunter2", true},
+		{"{SHA}87u9ZqY9S/F0eUBXjsPQEDUw4h0=", "wrong", false},
+		{string(bcryptHash), "hunter2", true},
+		{string(bcryptHash), "wrong", false},
+	}
+	for _, test := range tests {
+		if got := verifyPassword(test.hash, test.password); got != test.want {
+			t.Errorf("verifyPassword(%q, %q) = %v, want %v", test.hash, test.password, got, test.want)
+		}
+	}
+}
+
+// TestUnknownUserHash guards against newBasicAuthMiddleware's
+// known-username oracle: unknownUserHash must itself be a valid bcrypt
+// hash, so an unknown username pays bcrypt's cost rather than falling
+// through to a cheap comparison that would leak which usernames exist.
+func TestUnknownUserHash(t *testing.T) {
+	if !strings.HasPrefix(unknownUserHash, "$2a$") {
+		t.Fatalf("unknownUserHash = %q, want a $2a$ bcrypt hash", unknownUserHash)
+	}
+	if verifyPassword(unknownUserHash, "anything") {
+		t.Error("verifyPassword(unknownUserHash, ...) = true, want false")
+	}
+}
@@ -0,0 +1,295 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	upstreamUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "webfront_upstream_up",
+			Help: "Whether a backend is currently considered healthy (1) or down (0).",
+		},
+		[]string{"host", "backend"},
+	)
+	upstreamRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webfront_upstream_requests_total",
+			Help: "Requests proxied to each backend.",
+		},
+		[]string{"host", "backend"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(upstreamUp, upstreamRequests)
+}
+
+// HealthCheckConfig configures periodic HTTP health probing of a Rule's
+// upstream backends, in the style of blackbox_exporter's HTTP prober.
+type HealthCheckConfig struct {
+	Path            string // GET path to probe; defaults to "/"
+	IntervalSeconds int    // time between probes; defaults to 10
+	TimeoutSeconds  int    // per-probe timeout; defaults to 5
+	ExpectCodes     []int  // acceptable response codes; defaults to [200]
+	ExpectBody      string // optional substring the response body must contain
+}
+
+func (c *HealthCheckConfig) path() string {
+	if c.Path == "" {
+		return "/"
+	}
+	return c.Path
+}
+
+func (c *HealthCheckConfig) interval() time.Duration {
+	if c.IntervalSeconds <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.IntervalSeconds) * time.Second
+}
+
+func (c *HealthCheckConfig) timeout() time.Duration {
+	if c.TimeoutSeconds <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(c.TimeoutSeconds) * time.Second
+}
+
+func (c *HealthCheckConfig) accepts(code int) bool {
+	if len(c.ExpectCodes) == 0 {
+		return code == http.StatusOK
+	}
+	for _, want := range c.ExpectCodes {
+		if code == want {
+			return true
+		}
+	}
+	return false
+}
+
+// Backend is one upstream address of a load-balanced Rule, tracked for
+// health and in-flight request count.
+type Backend struct {
+	Addr string
+
+	mu       sync.Mutex
+	healthy  bool
+	inFlight int
+}
+
+func (b *Backend) isHealthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy
+}
+
+func (b *Backend) setHealthy(host string, v bool) {
+	b.mu.Lock()
+	changed := b.healthy != v
+	b.healthy = v
+	b.mu.Unlock()
+	if changed {
+		up := 0.0
+		if v {
+			up = 1.0
+		}
+		upstreamUp.With(prometheus.Labels{"host": host, "backend": b.Addr}).Set(up)
+	}
+}
+
+func (b *Backend) addInFlight(delta int) {
+	b.mu.Lock()
+	b.inFlight += delta
+	b.mu.Unlock()
+}
+
+func (b *Backend) load() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.inFlight
+}
+
+// Pool load-balances across a Rule's upstream Backends and tracks their
+// health via periodic HTTP probes.
+type Pool struct {
+	host     string // Rule.Host, used as a metrics label
+	strategy string // Rule.LoadBalance
+	backends []*Backend
+
+	next uint64 // atomic counter for round_robin
+
+	stop chan struct{} // closed by close to stop any running health checks
+}
+
+// newPool constructs a Pool that load-balances across addrs using
+// strategy ("" defaults to round_robin). All backends start out
+// healthy; if a HealthCheckConfig is later run against the Pool,
+// unhealthy backends are excluded from selection until they recover.
+func newPool(host string, addrs []string, strategy string) *Pool {
+	p := &Pool{host: host, strategy: strategy, stop: make(chan struct{})}
+	for _, a := range addrs {
+		p.backends = append(p.backends, &Backend{Addr: a, healthy: true})
+		upstreamUp.With(prometheus.Labels{"host": host, "backend": a}).Set(1)
+	}
+	return p
+}
+
+// close stops any health-check goroutines still probing p's backends.
+// It's called once p has been superseded by a rule reload, so a long-
+// running server doesn't accumulate one set of probing goroutines per
+// reload.
+func (p *Pool) close() {
+	close(p.stop)
+}
+
+// pick returns a healthy backend for req, or nil if none are healthy.
+func (p *Pool) pick(req *http.Request) *Backend {
+	healthy := make([]*Backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.isHealthy() {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	switch p.strategy {
+	case "random":
+		return healthy[rand.Intn(len(healthy))]
+	case "least_conn":
+		best := healthy[0]
+		for _, b := range healthy[1:] {
+			if b.load() < best.load() {
+				best = b
+			}
+		}
+		return best
+	case "ip_hash":
+		h := fnv.New32a()
+		io.WriteString(h, clientIP(req))
+		return healthy[h.Sum32()%uint32(len(healthy))]
+	default: // "round_robin"
+		n := atomic.AddUint64(&p.next, 1)
+		return healthy[(n-1)%uint64(len(healthy))]
+	}
+}
+
+// clientIP returns the IP portion of req's RemoteAddr.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+type contextKey int
+
+const (
+	pickedBackendsKey contextKey = iota
+	upstreamAddrKey
+)
+
+// proxyHandler returns a Handler that reverse-proxies each request to a
+// backend chosen by p, tracking in-flight counts for least_conn and
+// per-backend request totals.
+func (p *Pool) proxyHandler() http.Handler {
+	fallback := p.backends[0].Addr
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			b := p.pick(req)
+			if b == nil {
+				req.URL.Host = fallback
+				return
+			}
+			req.URL.Host = b.Addr
+			b.addInFlight(1)
+			upstreamRequests.With(prometheus.Labels{"host": p.host, "backend": b.Addr}).Inc()
+			if picked, ok := req.Context().Value(pickedBackendsKey).(*[]*Backend); ok {
+				*picked = append(*picked, b)
+			}
+			if addr, ok := req.Context().Value(upstreamAddrKey).(*string); ok {
+				*addr = b.Addr
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var picked []*Backend
+		ctx := context.WithValue(req.Context(), pickedBackendsKey, &picked)
+		proxy.ServeHTTP(w, req.WithContext(ctx))
+		for _, b := range picked {
+			b.addInFlight(-1)
+		}
+	})
+}
+
+// runHealthChecks probes each of p's backends at cfg's interval until
+// p is closed, marking them healthy or unhealthy based on the outcome.
+func (p *Pool) runHealthChecks(cfg *HealthCheckConfig) {
+	client := &http.Client{Timeout: cfg.timeout()}
+	for _, b := range p.backends {
+		go func(b *Backend) {
+			t := time.NewTicker(cfg.interval())
+			defer t.Stop()
+			for {
+				b.setHealthy(p.host, probeOnce(client, b.Addr, cfg))
+				select {
+				case <-t.C:
+				case <-p.stop:
+					return
+				}
+			}
+		}(b)
+	}
+}
+
+// probeOnce issues a single GET probe against addr and reports whether
+// it satisfies cfg's expectations.
+func probeOnce(client *http.Client, addr string, cfg *HealthCheckConfig) bool {
+	resp, err := client.Get("http://" + addr + cfg.path())
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if !cfg.accepts(resp.StatusCode) {
+		return false
+	}
+	if cfg.ExpectBody == "" {
+		return true
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(body), cfg.ExpectBody)
+}
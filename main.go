@@ -30,6 +30,41 @@ For all requests to the host example.com (or any name ending in
 For requests to example.org, it forwards the request to the HTTP
 server listening on localhost port 8080.
 
+Host also accepts a "*." wildcard, matching any number of subdomain
+levels (e.g. "*.frp1.com" matches both "test.frp1.com" and
+"new.test.frp1.com"), or a "~" regex form (e.g. "~^(foo|bar)\.com$").
+
+A rule may also carry a Path, scoping it to a URL path prefix (or a
+"~" regex), so several rules can share a Host, e.g. "/api/" forwarding
+to a backend while "/" serves static files. The most specific matching
+Path wins. A Middlewares list names, in order, the middleware (basic
+auth, IP allowlisting, request logging, gzip, header injection, rate
+limiting) to wrap around the rule's handler. Basic auth credentials may
+come from an inline Users map or an htpasswd file, with bcrypt, SHA1 or
+plaintext hashes; IP allowlisting checks RemoteAddr, or the X-Forwarded-For
+header when the peer is one of a configured set of trusted proxies.
+
+Forward may instead be a list of addresses (Forwards), load-balanced
+according to LoadBalance ("round_robin", "random", "least_conn" or
+"ip_hash"). A HealthCheck section periodically probes each address and
+takes it out of rotation until it recovers.
+
+A FastCGI section ({"Addr": "localhost:9000", "Root": "/var/www"})
+proxies the request straight to a FastCGI responder such as php-fpm,
+instead of Forward/Forwards or Serve.
+
+Every request is recorded in an access log, in Common or Combined Log
+Format (plus upstream address and latency) or as JSON lines, to stdout
+or to a rotated file, optionally also forwarded to syslog. The
+-access_log_* flags configure the server-wide log; a Rule's AccessLog
+section can override its format or opt it out entirely.
+
+If -metrics is set, webfront also exposes Prometheus metrics there:
+webfront_requests_total and webfront_request_duration_seconds (both
+labeled by host, method, response code and rule type),
+webfront_upstream_up (per backend, fed by HealthCheck) and
+webfront_in_flight_requests.
+
 Usage of webfront:
   -http address
     	HTTP listen address (default ":http")
@@ -52,12 +87,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"net/http/httputil"
 	"os"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/nf/webfront/fcgi"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/acme/autocert"
@@ -69,6 +105,14 @@ var (
 	letsCacheDir = flag.String("letsencrypt_cache", "", "letsencrypt cache `directory` (default is to disable HTTPS)")
 	ruleFile     = flag.String("rules", "", "rule definition `file`")
 	pollInterval = flag.Duration("poll", time.Second*10, "rule file poll `interval`")
+
+	accessLogFile       = flag.String("access_log_file", "", "access log output `file` (default stdout)")
+	accessLogFormat     = flag.String("access_log_format", "combined", "access log `format`: common, combined or json")
+	accessLogMaxSizeMB  = flag.Int("access_log_max_size_mb", 0, "rotate the access log file once it exceeds this many megabytes (0 disables rotation)")
+	accessLogMaxBackups = flag.Int("access_log_max_backups", 5, "number of rotated access log files to keep")
+	accessLogSyslog     = flag.String("access_log_syslog", "", "additionally forward access log entries to syslog, as \"local\" or \"network:address\"")
+
+	metricsBuckets = flag.String("metrics_buckets", defaultDurationBucketsFlag(), "comma-separated webfront_request_duration_seconds histogram bucket boundaries, in seconds")
 )
 
 var hitCounter = prometheus.NewCounterVec(
@@ -86,6 +130,26 @@ func init() {
 func main() {
 	flag.Parse()
 
+	logger, err := newAccessLogger(AccessLogConfig{
+		Format:     *accessLogFormat,
+		File:       *accessLogFile,
+		MaxSizeMB:  *accessLogMaxSizeMB,
+		MaxBackups: *accessLogMaxBackups,
+		Syslog:     *accessLogSyslog,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defaultAccessLogger = logger
+
+	buckets, err := parseBuckets(*metricsBuckets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	prometheus.Unregister(requestDuration)
+	requestDuration = newRequestDurationHistogram(buckets)
+	prometheus.MustRegister(requestDuration)
+
 	s, err := NewServer(*ruleFile, *pollInterval)
 	if err != nil {
 		log.Fatal(err)
@@ -125,11 +189,116 @@ type Server struct {
 
 // Rule represents a rule in a configuration file.
 type Rule struct {
-	Host    string // to match against request Host header
-	Forward string // non-empty if reverse proxy
-	Serve   string // non-empty if file server
+	Host string // to match against request Host header
+	Path string // to match against request URL path; "" matches all paths
+
+	Forward     string   // non-empty if reverse proxy to a single upstream
+	Forwards    []string // non-empty if reverse proxy, load-balanced across multiple upstreams
+	LoadBalance string   // "round_robin" (default), "random", "least_conn" or "ip_hash"
+	HealthCheck *HealthCheckConfig
+
+	Serve string // non-empty if file server
+
+	FastCGI *FastCGIConfig // non-empty if proxying to a FastCGI responder (e.g. php-fpm)
+
+	Middlewares []MiddlewareConfig // applied, in order, around the handler above
+
+	AccessLog *AccessLogConfig // overrides the server-wide access log's format, or opts this Rule out of it
 
 	handler http.Handler
+	pool    *Pool // backs Forward/Forwards, if either is set
+
+	hostKind  hostMatchKind
+	hostGlob  *regexp.Regexp // compiled from a "*." wildcard Host
+	hostRegex *regexp.Regexp // compiled from a "~" regex Host
+	pathRegex *regexp.Regexp // compiled from a "~" regex Path
+}
+
+// FastCGIConfig configures a Rule that proxies to a FastCGI responder
+// such as php-fpm, instead of an HTTP upstream.
+type FastCGIConfig struct {
+	Network string // "tcp" (default) or "unix"
+	Addr    string // responder address: "host:port" or a Unix socket path
+
+	Root  string // document root, used to build SCRIPT_FILENAME
+	Index string // file served for a request mapping to a directory; defaults to "index.php"
+}
+
+// hostMatchKind classifies how a Rule's Host field should be matched
+// against an incoming request's Host header.
+type hostMatchKind int
+
+const (
+	hostExact hostMatchKind = iota
+	hostWildcard
+	hostRegex
+)
+
+// compileHost classifies r.Host and, for the wildcard ("*.frp1.com") and
+// regex ("~^...$") forms, pre-compiles the matcher so it isn't rebuilt on
+// every request.
+func (r *Rule) compileHost() error {
+	switch {
+	case strings.HasPrefix(r.Host, "~"):
+		re, err := regexp.Compile(r.Host[1:])
+		if err != nil {
+			return fmt.Errorf("bad regex host %q: %v", r.Host, err)
+		}
+		r.hostKind = hostRegex
+		r.hostRegex = re
+	case strings.Contains(r.Host, "*"):
+		pattern := "^" + strings.Replace(regexp.QuoteMeta(r.Host), `\*`, `.+`, 1) + "$"
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("bad wildcard host %q: %v", r.Host, err)
+		}
+		r.hostKind = hostWildcard
+		r.hostGlob = re
+	default:
+		r.hostKind = hostExact
+	}
+	return nil
+}
+
+// matchesHost reports whether h, the request's Host header with any port
+// stripped, satisfies the rule's Host pattern.
+func (r *Rule) matchesHost(h string) bool {
+	switch r.hostKind {
+	case hostWildcard:
+		return r.hostGlob.MatchString(h)
+	case hostRegex:
+		return r.hostRegex.MatchString(h)
+	default:
+		return h == r.Host || strings.HasSuffix(h, "."+r.Host)
+	}
+}
+
+// compilePath pre-compiles r.Path if it is a "~" regex form.
+func (r *Rule) compilePath() error {
+	if !strings.HasPrefix(r.Path, "~") {
+		return nil
+	}
+	re, err := regexp.Compile(r.Path[1:])
+	if err != nil {
+		return fmt.Errorf("bad regex path %q: %v", r.Path, err)
+	}
+	r.pathRegex = re
+	return nil
+}
+
+// matchesPath reports whether p, the request's URL path, satisfies the
+// rule's Path pattern, along with a specificity score used to pick the
+// most specific of several rules that match the same host. An empty
+// Path matches every path, with the lowest possible specificity.
+func (r *Rule) matchesPath(p string) (ok bool, score int) {
+	switch {
+	case r.Path == "":
+		return true, 0
+	case r.pathRegex != nil:
+		return r.pathRegex.MatchString(p), len(r.Path)
+	default:
+		return strings.HasPrefix(p, r.Path), len(r.Path)
+	}
 }
 
 // NewServer constructs a Server that reads rules from file with a period
@@ -144,29 +313,55 @@ func NewServer(file string, poll time.Duration) (*Server, error) {
 }
 
 // ServeHTTP matches the Request with a Rule and, if found, serves the
-// request with the Rule's handler.
+// request with the Rule's handler. Every request, matched or not, is
+// recorded in the webfront_requests_total and
+// webfront_request_duration_seconds metrics, and in the access log
+// unless its Rule's AccessLog opts out.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if h := s.handler(r); h != nil {
-		h.ServeHTTP(w, r)
-		return
+	start := time.Now()
+	lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+	inFlightRequests.Inc()
+	defer inFlightRequests.Dec()
+
+	rule := s.match(r)
+	var upstream string
+	if rule == nil {
+		http.Error(lw, "Not found.", http.StatusNotFound)
+	} else {
+		ctx := context.WithValue(r.Context(), upstreamAddrKey, &upstream)
+		rule.handler.ServeHTTP(lw, r.WithContext(ctx))
 	}
-	http.Error(w, "Not found.", http.StatusNotFound)
+	dur := time.Since(start)
+	logAccess(rule, r, lw, upstream, dur)
+	instrumentRequest(rule, r, lw.status, dur)
 }
 
-// handler returns the appropriate Handler for the given Request,
-// or nil if none found.
-func (s *Server) handler(req *http.Request) http.Handler {
+// match returns the most specific Rule matching req, or nil if none
+// found.
+func (s *Server) match(req *http.Request) *Rule {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	h := req.Host
-	// Some clients include a port in the request host; strip it.
-	if i := strings.Index(h, ":"); i >= 0 {
-		h = h[:i]
-	}
-	for _, r := range s.rules {
-		if h == r.Host || strings.HasSuffix(h, "."+r.Host) {
-			hitCounter.With(prometheus.Labels{"host": r.Host}).Inc()
-			return r.handler
+	h := hostWithoutPort(req.Host)
+	// Exact (and legacy subdomain-suffix) matches take priority over
+	// wildcards, and wildcards over regexes, so a specific rule always
+	// wins over a broader one. Within a tier, the rule with the most
+	// specific (longest) matching Path wins, so e.g. "/api/" beats "/".
+	for _, kind := range []hostMatchKind{hostExact, hostWildcard, hostRegex} {
+		var best *Rule
+		bestScore := -1
+		for _, r := range s.rules {
+			if r.hostKind != kind || !r.matchesHost(h) {
+				continue
+			}
+			ok, score := r.matchesPath(req.URL.Path)
+			if ok && score > bestScore {
+				best, bestScore = r, score
+			}
+		}
+		if best != nil {
+			hitCounter.With(prometheus.Labels{"host": best.Host}).Inc()
+			return best
 		}
 	}
 	return nil
@@ -199,20 +394,31 @@ func (s *Server) loadRules(file string) error {
 		return err
 	}
 	s.mu.Lock()
+	old := s.rules
 	s.last = mtime
 	s.rules = rules
 	s.mu.Unlock()
+	// Every reload builds brand-new Pools; stop the superseded
+	// generation's health-check goroutines so they don't leak.
+	for _, r := range old {
+		if r.pool != nil {
+			r.pool.close()
+		}
+	}
 	return nil
 }
 
-// hostPolicy implements autocert.HostPolicy by consulting
-// the rules list for a matching host name.
+// hostPolicy implements autocert.HostPolicy by consulting the rules list
+// for a matching host name. Wildcard and regex rules are honored too:
+// autocert only ever asks about one concrete hostname at a time (never
+// the literal pattern), so a wildcard rule simply widens the set of
+// concrete hostnames it's acceptable to issue a certificate for.
 func (s *Server) hostPolicy(ctx context.Context, host string) error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	for _, rule := range s.rules {
-		if host == rule.Host || host == "www."+rule.Host {
+		if rule.matchesHost(host) || host == "www."+rule.Host {
 			return nil
 		}
 	}
@@ -232,26 +438,91 @@ func parseRules(file string) ([]*Rule, error) {
 		return nil, err
 	}
 	for _, r := range rules {
+		if err := r.compileHost(); err != nil {
+			log.Printf("bad rule: %v", err)
+			continue
+		}
+		if err := r.compilePath(); err != nil {
+			log.Printf("bad rule: %v", err)
+			continue
+		}
+		if r.AccessLog != nil {
+			if err := r.AccessLog.compile(); err != nil {
+				log.Printf("bad rule: %v", err)
+				continue
+			}
+		}
 		r.handler = makeHandler(r)
 		if r.handler == nil {
 			log.Printf("bad rule: %#v", r)
+			continue
 		}
+		mws, err := buildMiddlewares(r.Middlewares)
+		if err != nil {
+			log.Printf("bad rule: %v", err)
+			continue
+		}
+		r.handler = chain(mws, r.handler)
 	}
 	return rules, nil
 }
 
 // makeHandler constructs the appropriate Handler for the given Rule.
 func makeHandler(r *Rule) http.Handler {
-	if h := r.Forward; h != "" {
-		return &httputil.ReverseProxy{
-			Director: func(req *http.Request) {
-				req.URL.Scheme = "http"
-				req.URL.Host = h
-			},
+	if addrs := r.upstreams(); len(addrs) > 0 {
+		r.pool = newPool(r.Host, addrs, r.LoadBalance)
+		if r.HealthCheck != nil {
+			go r.pool.runHealthChecks(r.HealthCheck)
 		}
+		return r.pool.proxyHandler()
 	}
 	if d := r.Serve; d != "" {
 		return http.FileServer(http.Dir(d))
 	}
+	if r.FastCGI != nil {
+		return &fcgi.Transport{
+			Network: r.FastCGI.Network,
+			Addr:    r.FastCGI.Addr,
+			Root:    r.FastCGI.Root,
+			Index:   r.FastCGI.Index,
+		}
+	}
+	return nil
+}
+
+// upstreams returns the Rule's upstream addresses, accepting both the
+// single-address Forward field and the multi-address Forwards field.
+func (r *Rule) upstreams() []string {
+	if len(r.Forwards) > 0 {
+		return r.Forwards
+	}
+	if r.Forward != "" {
+		return []string{r.Forward}
+	}
 	return nil
 }
+
+// kind classifies r for the rule_type metrics label.
+func (r *Rule) kind() string {
+	switch {
+	case len(r.Forwards) > 0:
+		return "loadbalance"
+	case r.Forward != "":
+		return "forward"
+	case r.Serve != "":
+		return "serve"
+	case r.FastCGI != nil:
+		return "fastcgi"
+	default:
+		return "unknown"
+	}
+}
+
+// hostWithoutPort strips a trailing ":port" from h, a request's Host
+// header, some clients include.
+func hostWithoutPort(h string) string {
+	if i := strings.Index(h, ":"); i >= 0 {
+		return h[:i]
+	}
+	return h
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultDurationBuckets are webfront_request_duration_seconds'
+// histogram buckets until overridden by the -metrics_buckets flag.
+var defaultDurationBuckets = []float64{0.1, 0.3, 1.2, 5}
+
+var (
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webfront_requests_total",
+			Help: "Total requests handled, by host, method, response code and rule type.",
+		},
+		[]string{"host", "method", "code", "rule_type"},
+	)
+	inFlightRequests = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "webfront_in_flight_requests",
+			Help: "Requests currently being served.",
+		},
+	)
+	requestDuration = newRequestDurationHistogram(defaultDurationBuckets)
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, inFlightRequests, requestDuration)
+}
+
+// newRequestDurationHistogram constructs the webfront_request_duration_seconds
+// HistogramVec with the given bucket boundaries.
+func newRequestDurationHistogram(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "webfront_request_duration_seconds",
+			Help:    "Request latency in seconds, by host, method, response code and rule type.",
+			Buckets: buckets,
+		},
+		[]string{"host", "method", "code", "rule_type"},
+	)
+}
+
+// defaultDurationBucketsFlag is defaultDurationBuckets formatted as the
+// -metrics_buckets flag's default value, so the two can't drift apart.
+func defaultDurationBucketsFlag() string {
+	s := make([]string, len(defaultDurationBuckets))
+	for i, b := range defaultDurationBuckets {
+		s[i] = strconv.FormatFloat(b, 'g', -1, 64)
+	}
+	return strings.Join(s, ",")
+}
+
+// parseBuckets parses a comma-separated list of histogram bucket
+// boundaries, as taken by the -metrics_buckets flag. The boundaries
+// must be strictly increasing, as required by prometheus.NewHistogram.
+func parseBuckets(s string) ([]float64, error) {
+	fields := strings.Split(s, ",")
+	buckets := make([]float64, 0, len(fields))
+	for _, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad histogram bucket %q: %v", f, err)
+		}
+		if len(buckets) > 0 && v <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("histogram buckets must be strictly increasing, got %v then %v", buckets[len(buckets)-1], v)
+		}
+		buckets = append(buckets, v)
+	}
+	return buckets, nil
+}
+
+// instrumentRequest records a completed request's outcome in
+// requestsTotal and requestDuration. rule is nil for unmatched
+// ("notfound") requests.
+func instrumentRequest(rule *Rule, r *http.Request, status int, dur time.Duration) {
+	ruleType := "notfound"
+	if rule != nil {
+		ruleType = rule.kind()
+	}
+	labels := prometheus.Labels{
+		"host":      hostWithoutPort(r.Host),
+		"method":    r.Method,
+		"code":      strconv.Itoa(status),
+		"rule_type": ruleType,
+	}
+	requestsTotal.With(labels).Inc()
+	requestDuration.With(labels).Observe(dur.Seconds())
+}
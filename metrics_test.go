@@ -0,0 +1,56 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestParseBuckets(t *testing.T) {
+	got, err := parseBuckets("0.1, 0.3,1.2,5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{0.1, 0.3, 1.2, 5}
+	if len(got) != len(want) {
+		t.Fatalf("parseBuckets() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("parseBuckets()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if _, err := parseBuckets("0.1,oops"); err == nil {
+		t.Error("parseBuckets(\"0.1,oops\") returned nil error, want one")
+	}
+}
+
+func TestRuleKind(t *testing.T) {
+	var tests = []struct {
+		rule *Rule
+		want string
+	}{
+		{&Rule{Forward: "localhost:80"}, "forward"},
+		{&Rule{Forwards: []string{"localhost:80", "localhost:81"}}, "loadbalance"},
+		{&Rule{Serve: "/var/www"}, "serve"},
+		{&Rule{}, "unknown"},
+	}
+	for _, test := range tests {
+		if got := test.rule.kind(); got != test.want {
+			t.Errorf("kind() = %q, want %q", got, test.want)
+		}
+	}
+}
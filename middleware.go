@@ -0,0 +1,322 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Middleware wraps a terminal http.Handler to add cross-cutting behavior
+// (auth, logging, rate limiting, and so on) without changing the
+// handler itself.
+type Middleware func(http.Handler) http.Handler
+
+// MiddlewareConfig names a middleware and carries its settings, as
+// configured per-rule in the rules file. Only the fields relevant to
+// Type are read.
+type MiddlewareConfig struct {
+	Type string // "log", "gzip", "headers", "ratelimit", "basicauth" or "allowfrom"
+
+	Headers    map[string]string // for "headers": response headers to set
+	RatePerSec float64           // for "ratelimit": sustained requests/sec allowed
+	Burst      int               // for "ratelimit": burst size; defaults to 1
+
+	Users        map[string]string // for "basicauth": username -> bcrypt, SHA1 or plaintext hash
+	HtpasswdFile string            // for "basicauth": htpasswd file merged into Users at rule-load time
+
+	AllowFrom      []string // for "allowfrom": CIDRs permitted to connect
+	TrustedProxies []string // for "allowfrom": CIDRs of proxies whose X-Forwarded-For is trusted
+}
+
+// middlewareFactories maps a MiddlewareConfig's Type to the constructor
+// that builds it.
+var middlewareFactories = map[string]func(MiddlewareConfig) (Middleware, error){
+	"log":       newLogMiddleware,
+	"gzip":      newGzipMiddleware,
+	"headers":   newHeadersMiddleware,
+	"ratelimit": newRateLimitMiddleware,
+	"basicauth": newBasicAuthMiddleware,
+	"allowfrom": newAllowFromMiddleware,
+}
+
+// buildMiddlewares constructs the Middleware chain described by cfgs, in
+// order.
+func buildMiddlewares(cfgs []MiddlewareConfig) ([]Middleware, error) {
+	mws := make([]Middleware, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		factory, ok := middlewareFactories[cfg.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware type %q", cfg.Type)
+		}
+		mw, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s middleware: %v", cfg.Type, err)
+		}
+		mws = append(mws, mw)
+	}
+	return mws, nil
+}
+
+// chain wraps final with mws, applied outer-to-inner in list order, so
+// mws[0] sees the request first and final is called last.
+func chain(mws []Middleware, final http.Handler) http.Handler {
+	h := final
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// newLogMiddleware logs the method, host, path and latency of every
+// request it sees.
+func newLogMiddleware(MiddlewareConfig) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			next.ServeHTTP(w, r)
+			log.Printf("%s %s%s %s", r.Method, r.Host, r.URL.Path, time.Since(start))
+		})
+	}, nil
+}
+
+// newGzipMiddleware compresses the response body when the client
+// advertises support for it.
+func newGzipMiddleware(MiddlewareConfig) (Middleware, error) {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Add("Vary", "Accept-Encoding")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			next.ServeHTTP(&gzipResponseWriter{ResponseWriter: w, gz: gz}, r)
+		})
+	}, nil
+}
+
+// gzipResponseWriter wraps an http.ResponseWriter so that Write calls go
+// through a gzip.Writer.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+// WriteHeader strips any Content-Length the wrapped handler set (as
+// httputil.ReverseProxy does, copying it straight from the upstream
+// response) before flushing the header, since it describes the
+// uncompressed body and no longer matches what gz.Write will send.
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.gz.Write(b)
+}
+
+// Flush flushes any buffered, compressed bytes out of gz and, if the
+// wrapped ResponseWriter is an http.Flusher, on to the client, so that
+// streamed proxy responses still flush incrementally instead of
+// buffering until the handler returns.
+func (w *gzipResponseWriter) Flush() {
+	w.gz.Flush()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, if the wrapped ResponseWriter does,
+// so that WebSocket upgrades still work through the gzip wrapper.
+func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// newHeadersMiddleware sets a fixed set of response headers on every
+// request, useful for security headers or cache control.
+func newHeadersMiddleware(cfg MiddlewareConfig) (Middleware, error) {
+	if len(cfg.Headers) == 0 {
+		return nil, fmt.Errorf("Headers must not be empty")
+	}
+	headers := cfg.Headers
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for k, v := range headers {
+				w.Header().Set(k, v)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// newRateLimitMiddleware limits requests to cfg.RatePerSec sustained,
+// with bursts up to cfg.Burst, shared across all clients of the rule.
+func newRateLimitMiddleware(cfg MiddlewareConfig) (Middleware, error) {
+	if cfg.RatePerSec <= 0 {
+		return nil, fmt.Errorf("RatePerSec must be positive")
+	}
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+	limiter := rate.NewLimiter(rate.Limit(cfg.RatePerSec), burst)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !limiter.Allow() {
+				http.Error(w, "Too many requests.", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// newBasicAuthMiddleware requires one of cfg.Users' (merged with
+// cfg.HtpasswdFile's, if set) username/password pairs via HTTP Basic
+// authentication, comparing in constant time regardless of the hash
+// scheme. HtpasswdFile entries take precedence over cfg.Users on a
+// username collision.
+func newBasicAuthMiddleware(cfg MiddlewareConfig) (Middleware, error) {
+	users := make(map[string]string, len(cfg.Users))
+	for u, h := range cfg.Users {
+		users[u] = h
+	}
+	if cfg.HtpasswdFile != "" {
+		fileUsers, err := parseHtpasswd(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading HtpasswdFile: %v", err)
+		}
+		for u, h := range fileUsers {
+			users[u] = h
+		}
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("Users or HtpasswdFile must not be empty")
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, pass, ok := r.BasicAuth()
+			hash, known := users[user]
+			if !known {
+				hash = unknownUserHash // pay bcrypt's cost even for a nonexistent user
+			}
+			validPass := verifyPassword(hash, pass) // always run, so `known` alone can't be inferred from latency
+			if !ok || !known || !validPass {
+				w.Header().Set("WWW-Authenticate", `Basic realm="restricted"`)
+				http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// newAllowFromMiddleware permits requests only from the given CIDRs,
+// checked against the request's RemoteAddr, or the right-most address
+// in X-Forwarded-For that is not itself a trusted proxy when RemoteAddr
+// is one of cfg.TrustedProxies.
+func newAllowFromMiddleware(cfg MiddlewareConfig) (Middleware, error) {
+	nets, err := parseCIDRs(cfg.AllowFrom)
+	if err != nil {
+		return nil, err
+	}
+	if len(nets) == 0 {
+		return nil, fmt.Errorf("AllowFrom must not be empty")
+	}
+	proxies, err := parseCIDRs(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := requestIP(r, proxies)
+			for _, n := range nets {
+				if ip != nil && n.Contains(ip) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			http.Error(w, "Forbidden.", http.StatusForbidden)
+		})
+	}, nil
+}
+
+// parseCIDRs parses each of cidrs with net.ParseCIDR.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("bad CIDR %q: %v", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// requestIP returns r's real client address: RemoteAddr, unless
+// RemoteAddr is one of trustedProxies, in which case it's the
+// right-most address in X-Forwarded-For that isn't itself a trusted
+// proxy (so a proxy can't spoof its own entry).
+func requestIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	remote := hostIP(r.RemoteAddr)
+	if remote == nil || !containsIP(trustedProxies, remote) {
+		return remote
+	}
+	parts := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(parts) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(parts[i]))
+		if ip != nil && !containsIP(trustedProxies, ip) {
+			return ip
+		}
+	}
+	return remote
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostIP parses the IP address out of hostport, which may or may not
+// carry a port.
+func hostIP(hostport string) net.IP {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return net.ParseIP(host)
+}
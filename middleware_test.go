@@ -0,0 +1,51 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequestIP(t *testing.T) {
+	proxies, err := parseCIDRs([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		{"untrusted peer, XFF ignored", "203.0.113.5:1234", "198.51.100.9", "203.0.113.5"},
+		{"trusted proxy, client from XFF", "10.1.2.3:1234", "198.51.100.9", "198.51.100.9"},
+		{"trusted proxy chain, right-most untrusted address wins", "10.1.2.3:1234", "198.51.100.9, 10.1.2.3", "198.51.100.9"},
+		{"trusted proxy, no XFF", "10.1.2.3:1234", "", "10.1.2.3"},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "http://example.com/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.xff != "" {
+			r.Header.Set("X-Forwarded-For", test.xff)
+		}
+		if got := requestIP(r, proxies); got.String() != test.want {
+			t.Errorf("%s: requestIP() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
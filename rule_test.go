@@ -1,67 +1,60 @@
-package main
-
-import (
-	"bytes"
-	"encoding/json"
-	"io/ioutil"
-	"net/http"
-	"net/http/httptest"
-	"os"
-	"testing"
-	"time"
-)
+/*
+Copyright 2011 Google Inc.
 
-func TestParseRules(t *testing.T) {
-	target := httptest.NewServer(http.HandlerFunc(testHandler))
-	defer target.Close()
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
 
-	ruleFile, err := writeRules([]*Rule{
-		{Host: "example.com", Forward: target.Listener.Addr().String()},
-		{Host: "example.org", Serve: "testdata"},
-	})
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.Remove(ruleFile)
+     http://www.apache.org/licenses/LICENSE-2.0
 
-	s, err := NewServer(ruleFile, time.Hour)
-	if err != nil {
-		t.Fatal(err)
-	}
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
 
-	testRequest(t, s, "http://example.com/", "OK")
-	testRequest(t, s, "http://example.org/", "contents of index.html\n")
-}
+package main
 
-func testHandler(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("OK"))
-}
+import "testing"
 
-func testRequest(t *testing.T, h http.Handler, url string, wantBody string) {
-	rw := httptest.NewRecorder()
-	rw.Body = new(bytes.Buffer)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
+func TestWildcardHostMatching(t *testing.T) {
+	r := &Rule{Host: "*.frp1.com"}
+	if err := r.compileHost(); err != nil {
 		t.Fatal(err)
 	}
-	h.ServeHTTP(rw, req)
-	if g, w := rw.Code, http.StatusOK; g != w {
-		t.Errorf("GET %s StatusCode = %d, want %d", url, g, w)
+	var tests = []struct {
+		host string
+		want bool
+	}{
+		{"test.frp1.com", true},
+		{"new.test.frp1.com", true},
+		{"frp1.com", false},
+		{"test.frp1.org", false},
 	}
-	if g, w := rw.Body.String(), wantBody; g != w {
-		t.Errorf("GET %s Body = %q, want %q", url, g, w)
+	for _, test := range tests {
+		if got := r.matchesHost(test.host); got != test.want {
+			t.Errorf("matchesHost(%q) = %v, want %v", test.host, got, test.want)
+		}
 	}
 }
 
-func writeRules(rules []*Rule) (name string, err error) {
-	f, err := ioutil.TempFile("", "webfront-rules")
-	if err != nil {
-		return
+func TestRegexHostMatching(t *testing.T) {
+	r := &Rule{Host: `~^(foo|bar)\.example\.com$`}
+	if err := r.compileHost(); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		host string
+		want bool
+	}{
+		{"foo.example.com", true},
+		{"bar.example.com", true},
+		{"baz.example.com", false},
 	}
-	defer f.Close()
-	err = json.NewEncoder(f).Encode(rules)
-	if err != nil {
-		return
+	for _, test := range tests {
+		if got := r.matchesHost(test.host); got != test.want {
+			t.Errorf("matchesHost(%q) = %v, want %v", test.host, got, test.want)
+		}
 	}
-	return f.Name(), nil
 }
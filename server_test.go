@@ -18,11 +18,15 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -75,12 +79,15 @@ func TestServer(t *testing.T) {
 		}
 	}
 
+	// Location is a plain response header as far as httputil.ReverseProxy
+	// is concerned, so it's passed through to the client unmodified,
+	// whether or not it happens to point back at the rule's own Host.
 	var redirectTests = []struct {
 		url      string
 		code     int
 		location string
 	}{
-		{"http://example.localredirect/", 302, "https://example.localredirect:443"},
+		{"http://example.localredirect/", 302, "http://a.local.adress"},
 		{"http://example.globalredirect/", 302, "https://global.example.globalredirect"},
 	}
 
@@ -98,6 +105,334 @@ func TestServer(t *testing.T) {
 	}
 }
 
+func TestPathRules(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer api.Close()
+
+	ruleFile := writeRules([]*Rule{
+		{Host: "example.com", Path: "/api/", Forward: api.Listener.Addr().String()},
+		{Host: "example.com", Serve: "testdata"},
+	})
+	defer os.Remove(ruleFile)
+
+	s, err := NewServer(ruleFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		url  string
+		code int
+		body string
+	}{
+		{"http://example.com/api/foo", 200, "OK"},
+		{"http://example.com/", 200, "contents of index.html\n"},
+	}
+	for _, test := range tests {
+		rw := httptest.NewRecorder()
+		rw.Body = new(bytes.Buffer)
+		req, _ := http.NewRequest("GET", test.url, nil)
+		s.ServeHTTP(rw, req)
+		if g, w := rw.Code, test.code; g != w {
+			t.Errorf("%s: code = %d, want %d", test.url, g, w)
+		}
+		if g, w := rw.Body.String(), test.body; g != w {
+			t.Errorf("%s: body = %q, want %q", test.url, g, w)
+		}
+	}
+}
+
+func TestBasicAuthMiddleware(t *testing.T) {
+	ruleFile := writeRules([]*Rule{
+		{
+			Host:  "secure.example.com",
+			Serve: "testdata",
+			Middlewares: []MiddlewareConfig{
+				{Type: "basicauth", Users: map[string]string{"alice": "hunter2"}},
+			},
+		},
+	})
+	defer os.Remove(ruleFile)
+
+	s, err := NewServer(ruleFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://secure.example.com/", nil)
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("no credentials: code = %d, want %d", rw.Code, http.StatusUnauthorized)
+	}
+
+	req.SetBasicAuth("alice", "hunter2")
+	rw = httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("correct credentials: code = %d, want %d", rw.Code, http.StatusOK)
+	}
+}
+
+func TestHeadersMiddleware(t *testing.T) {
+	ruleFile := writeRules([]*Rule{
+		{
+			Host:  "headers.example.com",
+			Serve: "testdata",
+			Middlewares: []MiddlewareConfig{
+				{Type: "headers", Headers: map[string]string{"X-Frame-Options": "DENY"}},
+			},
+		},
+	})
+	defer os.Remove(ruleFile)
+
+	s, err := NewServer(ruleFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://headers.example.com/", nil)
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+	if g, w := rw.Header().Get("X-Frame-Options"), "DENY"; g != w {
+		t.Errorf("X-Frame-Options = %q, want %q", g, w)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	ruleFile := writeRules([]*Rule{
+		{
+			Host:  "ratelimit.example.com",
+			Serve: "testdata",
+			Middlewares: []MiddlewareConfig{
+				{Type: "ratelimit", RatePerSec: 1, Burst: 1},
+			},
+		},
+	})
+	defer os.Remove(ruleFile)
+
+	s, err := NewServer(ruleFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://ratelimit.example.com/", nil)
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("first request: code = %d, want %d", rw.Code, http.StatusOK)
+	}
+
+	rw = httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("request exceeding burst: code = %d, want %d", rw.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestAllowFromMiddleware(t *testing.T) {
+	ruleFile := writeRules([]*Rule{
+		{
+			Host:  "allowfrom.example.com",
+			Serve: "testdata",
+			Middlewares: []MiddlewareConfig{
+				{Type: "allowfrom", AllowFrom: []string{"10.0.0.0/8"}},
+			},
+		},
+	})
+	defer os.Remove(ruleFile)
+
+	s, err := NewServer(ruleFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://allowfrom.example.com/", nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("CIDR miss: code = %d, want %d", rw.Code, http.StatusForbidden)
+	}
+
+	req.RemoteAddr = "10.1.2.3:1234"
+	rw = httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("CIDR hit: code = %d, want %d", rw.Code, http.StatusOK)
+	}
+}
+
+// TestGzipMiddlewareDropsUpstreamContentLength guards against
+// httputil.ReverseProxy's copied Content-Length surviving onto a gzip
+// middleware's (shorter, compressed) body, which would otherwise leave
+// the client reading a response its Content-Length claims is longer
+// than what's actually sent.
+func TestGzipMiddlewareDropsUpstreamContentLength(t *testing.T) {
+	const body = "a response long enough to be worth compressing, repeated: " +
+		"a response long enough to be worth compressing, repeated."
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer target.Close()
+
+	ruleFile := writeRules([]*Rule{
+		{
+			Host:    "gzip.example.com",
+			Forward: target.Listener.Addr().String(),
+			Middlewares: []MiddlewareConfig{
+				{Type: "gzip"},
+			},
+		},
+	})
+	defer os.Remove(ruleFile)
+
+	s, err := NewServer(ruleFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "http://gzip.example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+
+	if got := rw.Header().Get("Content-Length"); got != "" {
+		t.Errorf("Content-Length = %q, want it absent for a compressed body", got)
+	}
+
+	gz, err := gzip.NewReader(rw.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	got, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("reading gzip body: %v", err)
+	}
+	if string(got) != body {
+		t.Errorf("body = %q, want %q", got, body)
+	}
+}
+
+// TestGzipMiddlewareFlushesIncrementally guards against gzipResponseWriter
+// silently dropping http.Flusher support: without forwarding Flush, a
+// streaming Forward response buffers entirely inside gzip.Writer until
+// the handler returns, instead of reaching the client as each chunk is
+// flushed upstream.
+func TestGzipMiddlewareFlushesIncrementally(t *testing.T) {
+	secondChunk := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first chunk"))
+		w.(http.Flusher).Flush()
+		<-secondChunk
+		w.Write([]byte("second chunk"))
+	}))
+	defer target.Close()
+
+	ruleFile := writeRules([]*Rule{
+		{
+			Host:    "stream.example.com",
+			Forward: target.Listener.Addr().String(),
+			Middlewares: []MiddlewareConfig{
+				{Type: "gzip"},
+			},
+		},
+	})
+	defer os.Remove(ruleFile)
+
+	s, err := NewServer(ruleFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(s)
+	defer front.Close()
+	defer close(secondChunk)
+
+	req, err := http.NewRequest("GET", front.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "stream.example.com"
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := make([]byte, len("first chunk"))
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(gz, first)
+		read <- err
+	}()
+
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatalf("reading first chunk: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("first chunk never arrived; gzip middleware is not flushing incrementally")
+	}
+	if string(first) != "first chunk" {
+		t.Errorf("first chunk = %q, want %q", first, "first chunk")
+	}
+}
+
+// TestHealthCheckReloadStopsOldPool guards against a reload leaking the
+// previous generation's health-check goroutines: each reload builds a
+// brand-new Pool for every rule, even when its content is unchanged, so
+// the superseded Pool's probes must be stopped explicitly.
+func TestHealthCheckReloadStopsOldPool(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(testHandler))
+	defer target.Close()
+
+	ruleFile := writeRules([]*Rule{
+		{
+			Host:        "hc.example.com",
+			Forward:     target.Listener.Addr().String(),
+			HealthCheck: &HealthCheckConfig{IntervalSeconds: 1},
+		},
+	})
+	defer os.Remove(ruleFile)
+
+	s, err := NewServer(ruleFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond) // let the first generation's health-check goroutine start
+	before := runtime.NumGoroutine()
+
+	mtime := time.Now()
+	for i := 0; i < 5; i++ {
+		mtime = mtime.Add(time.Second)
+		if err := os.Chtimes(ruleFile, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.loadRules(ruleFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var after int
+	for i := 0; i < 50; i++ {
+		after = runtime.NumGoroutine()
+		if after <= before {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after > before {
+		t.Errorf("goroutine count grew from %d to %d after 5 reloads of a health-checked rule, want it to stay flat", before, after)
+	}
+}
+
 func testHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
@@ -122,3 +457,44 @@ func writeRules(rules []*Rule) (name string) {
 	}
 	return f.Name()
 }
+
+func TestLoadBalancing(t *testing.T) {
+	const n = 3
+	var hits [n]int32
+	var targets []*httptest.Server
+	var addrs []string
+	for i := 0; i < n; i++ {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+			w.Write([]byte("OK"))
+		}))
+		defer ts.Close()
+		targets = append(targets, ts)
+		addrs = append(addrs, ts.Listener.Addr().String())
+	}
+
+	ruleFile := writeRules([]*Rule{
+		{Host: "lb.example.com", Forwards: addrs, LoadBalance: "round_robin"},
+	})
+	defer os.Remove(ruleFile)
+
+	s, err := NewServer(ruleFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n*2; i++ {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://lb.example.com/", nil)
+		s.ServeHTTP(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Fatalf("request %d: code = %d, want 200", i, rw.Code)
+		}
+	}
+	for i, h := range hits {
+		if got := atomic.LoadInt32(&h); got != 2 {
+			t.Errorf("backend %d got %d hits, want 2", i, got)
+		}
+	}
+}